@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth validates incoming requests before they are forwarded or served from cache.
+type Auth interface {
+	// Validate reports whether the request is authorized. Implementations that
+	// reject the request are responsible for writing the failure response
+	// (status code, WWW-Authenticate header, etc.) before returning false.
+	Validate(w http.ResponseWriter, r *http.Request) bool
+}
+
+// NewAuth parses a URL-style auth spec and returns the matching Auth
+// implementation. Supported schemes:
+//
+//	none://                        - allow every request
+//	static://<token>               - require X-TWC-Cache-Auth: <token>
+//	basicfile:///path/to/htpasswd  - HTTP Basic auth against a colon-separated
+//	                                 file of bcrypt password hashes
+//	header://<name>/<value>        - require a header named <name> to equal <value>
+//
+// The scheme is split out with a plain string cut rather than url.Parse, so
+// that a token or header value containing "?" or "#" isn't silently
+// truncated at a query/fragment boundary the operator never intended.
+func NewAuth(paramstr string) (Auth, error) {
+	scheme, rest, ok := strings.Cut(paramstr, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid auth spec %q: missing \"://\"", paramstr)
+	}
+
+	switch scheme {
+	case "none":
+		return noneAuth{}, nil
+
+	case "static":
+		token := rest
+		if token == "" {
+			return nil, fmt.Errorf("static auth requires a token: %q", paramstr)
+		}
+		return staticAuth{token: token}, nil
+
+	case "basicfile":
+		path := rest
+		if path == "" {
+			return nil, fmt.Errorf("basicfile auth requires a file path: %q", paramstr)
+		}
+		creds, err := loadHtpasswd(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading basicfile %q: %v", path, err)
+		}
+		return basicFileAuth{creds: creds}, nil
+
+	case "header":
+		name, value, _ := strings.Cut(rest, "/")
+		if name == "" {
+			return nil, fmt.Errorf("header auth requires a header name: %q", paramstr)
+		}
+		return headerAuth{name: name, value: value}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", scheme)
+	}
+}
+
+// noneAuth allows every request through. Useful for local testing.
+type noneAuth struct{}
+
+func (noneAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	return true
+}
+
+// staticAuth requires the X-TWC-Cache-Auth header to match a shared secret,
+// compared in constant time.
+type staticAuth struct {
+	token string
+}
+
+func (a staticAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	got := r.Header.Get(authHeaderName)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// headerAuth requires an arbitrary header to carry a fixed value.
+type headerAuth struct {
+	name  string
+	value string
+}
+
+func (a headerAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	got := r.Header.Get(a.name)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(a.value)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// basicFileAuth validates HTTP Basic credentials against an htpasswd-style
+// file of "user:bcrypt-hash" lines.
+type basicFileAuth struct {
+	creds map[string]string
+}
+
+func (a basicFileAuth) Validate(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if ok {
+		if hash, found := a.creds[user]; found && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil {
+			return true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="twc-cache"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// loadHtpasswd reads a colon-separated "user:bcrypt-hash" file into a map,
+// skipping blank lines and "#" comments.
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		creds[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
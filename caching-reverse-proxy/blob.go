@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Blob storage configuration.
+const (
+	blobDirName       = "blobs"
+	blobSweepInterval = 10 * time.Minute
+)
+
+// spoolResponse streams src to dst (the client) while writing a copy to a
+// temp file under dbDirName, bounded by maxBodyBytes so a single response
+// can't pin unlimited memory or disk. It returns the path to the spooled
+// temp file, its size, and its SHA-256 sum; the caller must either promote
+// the file to a permanent blob (promoteToBlob) or remove it.
+func spoolResponse(dst io.Writer, src io.Reader, maxBodyBytes int64) (tmpPath string, size int64, sum string, err error) {
+	tmpFile, err := os.CreateTemp(dbDirName, "blob-*.tmp")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer tmpFile.Close()
+
+	hasher := sha256.New()
+	limited := io.LimitReader(src, maxBodyBytes)
+	size, err = io.Copy(io.MultiWriter(dst, tmpFile, hasher), limited)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", 0, "", err
+	}
+	return tmpFile.Name(), size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// blobPathFor returns the content-addressed path a blob with the given
+// SHA-256 sum lives at.
+func blobPathFor(sum string) string {
+	return filepath.Join(dbDirName, blobDirName, sum[:2], sum)
+}
+
+// promoteToBlob moves tmpPath to its content-addressed location, reusing an
+// existing blob with the same hash instead of writing a duplicate.
+func promoteToBlob(tmpPath, sum string) (string, error) {
+	dst := blobPathFor(sum)
+	if _, err := os.Stat(dst); err == nil {
+		os.Remove(tmpPath)
+		return dst, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return dst, nil
+}
+
+// startBlobSweeper periodically deletes blob files on disk that are no
+// longer referenced by any cache row, e.g. because the row was evicted by
+// INSERT OR REPLACE or expired and got overwritten.
+func startBlobSweeper() {
+	ticker := time.NewTicker(blobSweepInterval)
+	go func() {
+		for range ticker.C {
+			sweepOrphanBlobs()
+		}
+	}()
+}
+
+func sweepOrphanBlobs() {
+	root := filepath.Join(dbDirName, blobDirName)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return
+	}
+
+	rows, err := db.Query("SELECT blob_path FROM cache WHERE blob_path IS NOT NULL")
+	if err != nil {
+		log.Printf("Error listing referenced blobs: %v", err)
+		return
+	}
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil {
+			referenced[p] = true
+		}
+	}
+	rows.Close()
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if referenced[path] {
+			return nil
+		}
+		// promoteToBlob renames a response into place before the row
+		// referencing it is inserted, so a blob that was only just promoted
+		// may not have a row yet even though it isn't actually orphaned.
+		// Leave anything younger than one sweep interval for next time.
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < blobSweepInterval {
+			return nil
+		}
+		if rmErr := os.Remove(path); rmErr != nil {
+			log.Printf("Error removing orphan blob %q: %v", path, rmErr)
+		} else {
+			log.Printf("Removed orphan blob %q", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+)
+
+var (
+	// mitmSigner is non-nil when -mitm is enabled and a CA was loaded.
+	mitmSigner *caSigner
+	// mitmAllow gates which CONNECT hosts get MITM'd; everything else is
+	// tunneled verbatim.
+	mitmAllow *regexp.Regexp
+)
+
+// reqHostMatches reports whether r's CONNECT host matches the allow regex.
+// A nil regex matches nothing, so MITM stays opt-in per host.
+func reqHostMatches(r *http.Request, allow *regexp.Regexp) bool {
+	if allow == nil {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return allow.MatchString(host)
+}
+
+// forwardProxyHandler serves the second listen mode: a standard HTTP_PROXY
+// endpoint. Plain HTTP requests arrive in absolute-form and go through
+// serveTarget keyed by that absolute URL, so they are cached like twc_url
+// requests; HTTPS requests arrive as CONNECT and are tunneled or MITM'd.
+func forwardProxyHandler(w http.ResponseWriter, r *http.Request) {
+	if !auth.Validate(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		handleConnect(w, r)
+		return
+	}
+
+	serveTarget(w, r, r.URL.String())
+}
+
+// handleConnect hijacks a CONNECT request's connection, acknowledges it, and
+// either MITMs it (when enabled and the host is allow-listed) or tunnels
+// bytes verbatim in both directions.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Error hijacking connection: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		clientConn.Close()
+		return
+	}
+
+	if mitmSigner != nil && reqHostMatches(r, mitmAllow) {
+		mitmConnect(clientConn, r.Host)
+		return
+	}
+	tunnelConnect(clientConn, r.Host)
+}
+
+// tunnelConnect dials host and copies bytes verbatim in both directions
+// without attempting to interpret the tunneled protocol.
+func tunnelConnect(clientConn net.Conn, host string) {
+	defer clientConn.Close()
+
+	target, err := net.Dial("tcp", host)
+	if err != nil {
+		log.Printf("Error dialing CONNECT target %q: %v", host, err)
+		return
+	}
+	defer target.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(target, clientConn); done <- struct{}{} }()
+	go func() { io.Copy(clientConn, target); done <- struct{}{} }()
+	<-done
+}
+
+// mitmConnect terminates TLS on clientConn using a leaf certificate for host
+// signed by the configured CA, then replays each decrypted request through
+// serveTarget so responses are cached like any other request.
+func mitmConnect(clientConn net.Conn, host string) {
+	defer clientConn.Close()
+
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	leaf, err := mitmSigner.leafFor(hostname)
+	if err != nil {
+		log.Printf("Error minting MITM certificate for %q: %v", hostname, err)
+		return
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{Certificates: []tls.Certificate{*leaf}})
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("MITM handshake failed for %q: %v", hostname, err)
+		return
+	}
+	defer tlsConn.Close()
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading MITM'd request for %q: %v", hostname, err)
+			}
+			return
+		}
+
+		absoluteURL := (&url.URL{Scheme: "https", Host: host, Opaque: "", Path: req.URL.Path, RawQuery: req.URL.RawQuery}).String()
+		rw := newConnResponseWriter(tlsConn)
+		serveTarget(rw, req, absoluteURL)
+		req.Body.Close()
+		if err := rw.finish(); err != nil {
+			log.Printf("Error finishing MITM'd response for %q: %v", hostname, err)
+			return
+		}
+	}
+}
+
+// connResponseWriter is a minimal http.ResponseWriter that writes directly
+// to a raw connection, for replaying MITM'd requests that have no
+// surrounding http.Server to drive one. Unlike a real http.Server, nothing
+// else here frames the response body, so when a handler doesn't set
+// Content-Length (true of most real-world responses, which are chunked or
+// have their length stripped by fetchAndCache) it chunk-encodes the body
+// itself; otherwise the client would have no way to tell where the response
+// ends on the persistent MITM'd connection.
+type connResponseWriter struct {
+	conn        net.Conn
+	header      http.Header
+	wroteHeader bool
+	chunked     io.WriteCloser
+}
+
+func newConnResponseWriter(conn net.Conn) *connResponseWriter {
+	return &connResponseWriter{conn: conn, header: make(http.Header)}
+}
+
+func (w *connResponseWriter) Header() http.Header { return w.header }
+
+func (w *connResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.header.Get("Content-Length") == "" {
+		w.header.Set("Transfer-Encoding", "chunked")
+		w.chunked = httputil.NewChunkedWriter(w.conn)
+	}
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	w.header.Write(w.conn)
+	fmt.Fprint(w.conn, "\r\n")
+}
+
+func (w *connResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.chunked != nil {
+		return w.chunked.Write(b)
+	}
+	return w.conn.Write(b)
+}
+
+// finish closes out chunked framing, if any, writing the terminating
+// zero-length chunk so the client knows the response is complete and the
+// connection is ready for the next MITM'd request.
+func (w *connResponseWriter) finish() error {
+	if w.chunked == nil {
+		return nil
+	}
+	return w.chunked.Close()
+}
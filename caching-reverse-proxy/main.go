@@ -6,11 +6,13 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -25,10 +27,12 @@ const (
 	cacheHitHeaderName = "X-TWC-From-Cache"
 
 	// Query parameters to control caching.
-	targetURLParam   = "twc_url"
-	skipCacheParam   = "twc_skip_cache"   // optional
-	cacheExpiryParam = "twc_cache_expiry" // in seconds; optional
-	timeoutParam     = "twc_timeout"      // in seconds; optional
+	targetURLParam    = "twc_url"
+	skipCacheParam    = "twc_skip_cache"   // optional
+	cacheExpiryParam  = "twc_cache_expiry" // in seconds; optional
+	timeoutParam      = "twc_timeout"      // in seconds; optional
+	streamParam       = "twc_stream"       // optional; forces chunked passthrough
+	maxBodyBytesParam = "twc_max_body_bytes"
 
 	// Data configuration.
 	dbDirName  = "data"
@@ -36,20 +40,84 @@ const (
 )
 
 var (
-	db              *sql.DB
-	authHeaderValue string
+	db     *sql.DB
+	auth   Auth
+	pool   *upstreamPool
+	routes *RouteConfig
+
+	inlineThresholdBytes int64
+	maxBodyBytes         int64
 )
 
-func init() {
-	// Load the API key from the environment variable or use a default value.
-	authHeaderValue = os.Getenv("CACHE_API_KEY")
-	if authHeaderValue == "" {
-		authHeaderValue = "testing"
+// defaultAuthSpec builds the auth spec used when neither -auth nor CACHE_AUTH
+// is set, preserving the historical shared-secret behavior driven by
+// CACHE_API_KEY (defaulting to "testing").
+func defaultAuthSpec() string {
+	token := os.Getenv("CACHE_API_KEY")
+	if token == "" {
+		token = "testing"
 	}
+	return "static://" + token
 }
 
 func main() {
+	authFlag := flag.String("auth", "", "auth scheme spec, e.g. static://token, basicfile:///etc/twc/htpasswd, header://name/value, none:// (default: env CACHE_AUTH, or static:// from CACHE_API_KEY)")
+	upstreamFileFlag := flag.String("upstream-file", defaultUpstreamFile, "file of upstream proxies to chain outbound requests through (one per line, as produced by proxy-tester)")
+	inlineThresholdFlag := flag.Int64("inline-threshold-bytes", 256*1024, "responses at or under this size are stored inline in the database; larger ones spill to a blob file")
+	maxBodyBytesFlag := flag.Int64("max-body-bytes", 500*1024*1024, "hard cap on a single response body; excess bytes are discarded")
+	proxyAddrFlag := flag.String("proxy-addr", "", "if set, also listen here as a standard forward proxy (HTTP_PROXY) with CONNECT support")
+	mitmFlag := flag.Bool("mitm", false, "MITM CONNECT tunnels for allow-listed hosts instead of tunneling them verbatim")
+	mitmCACertFlag := flag.String("mitm-ca-cert", "", "PEM file with the CA certificate used to sign per-host MITM leaf certificates")
+	mitmCAKeyFlag := flag.String("mitm-ca-key", "", "PEM file with the CA private key used to sign per-host MITM leaf certificates")
+	mitmAllowFlag := flag.String("mitm-allow", "", "regex of hosts allowed to be MITM'd; every other CONNECT tunnel passes through verbatim")
+	configFlag := flag.String("config", "", "YAML or JSON file of routes with per-route cache policy (see Route in routes.go)")
+	flag.Parse()
+
+	inlineThresholdBytes = *inlineThresholdFlag
+	maxBodyBytes = *maxBodyBytesFlag
+
+	if *configFlag != "" {
+		cfg, err := loadRouteConfig(*configFlag)
+		if err != nil {
+			log.Fatal("Error loading route config:", err)
+		}
+		routes = cfg
+	}
+
+	if *mitmFlag {
+		if *mitmCACertFlag == "" || *mitmCAKeyFlag == "" {
+			log.Fatal("-mitm requires -mitm-ca-cert and -mitm-ca-key")
+		}
+		signer, err := loadCASigner(*mitmCACertFlag, *mitmCAKeyFlag)
+		if err != nil {
+			log.Fatal("Error loading MITM CA:", err)
+		}
+		mitmSigner = signer
+
+		if *mitmAllowFlag != "" {
+			allow, err := regexp.Compile(*mitmAllowFlag)
+			if err != nil {
+				log.Fatal("Error compiling -mitm-allow regex:", err)
+			}
+			mitmAllow = allow
+		}
+	}
+
+	authSpec := *authFlag
+	if authSpec == "" {
+		authSpec = os.Getenv("CACHE_AUTH")
+	}
+	if authSpec == "" {
+		authSpec = defaultAuthSpec()
+	}
 	var err error
+	auth, err = NewAuth(authSpec)
+	if err != nil {
+		log.Fatal("Error configuring auth:", err)
+	}
+
+	pool = newUpstreamPool(*upstreamFileFlag)
+
 	// Create the data directory if it does not exist.
 	if err = os.MkdirAll(dbDirName, 0755); err != nil {
 		log.Fatal("Error creating data directory:", err)
@@ -73,11 +141,14 @@ func main() {
 		log.Fatal("Error setting busy timeout:", err)
 	}
 
-	// Create cache table if it does not exist.
+	// Create cache table if it does not exist. Small responses are stored
+	// inline in `response`; larger ones spill to a blob file referenced by
+	// `blob_path`, with `response` left NULL.
 	createTableSQL := `
 	CREATE TABLE IF NOT EXISTS cache (
 		key TEXT PRIMARY KEY,
-		response TEXT,
+		response BLOB,
+		blob_path TEXT,
 		headers TEXT,
 		status_code INTEGER,
 		created_at TIMESTAMP,
@@ -87,15 +158,26 @@ func main() {
 		log.Fatal(err)
 	}
 
+	startBlobSweeper()
+
+	if *proxyAddrFlag != "" {
+		go func() {
+			log.Println("Forward proxy listening on", *proxyAddrFlag)
+			log.Fatal(http.ListenAndServe(*proxyAddrFlag, http.HandlerFunc(forwardProxyHandler)))
+		}()
+	}
+
 	http.HandleFunc("/", handler)
 	log.Println("Server started on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+// handler serves the cooperative-rewrite mode: clients pass the URL to fetch
+// as the twc_url query parameter.
 func handler(w http.ResponseWriter, r *http.Request) {
-	// Enforce the unique auth header.
-	if r.Header.Get(authHeaderName) != authHeaderValue {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Enforce the configured auth scheme. Implementations write their own
+	// failure response (status code, WWW-Authenticate header, etc).
+	if !auth.Validate(w, r) {
 		return
 	}
 
@@ -110,19 +192,50 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine whether to skip the cache.
-	skipCache := r.URL.Query().Get(skipCacheParam) == "true"
+	serveTarget(w, r, targetURL)
+}
+
+// serveTarget fetches targetURL (serving from cache when possible) and
+// writes the result to w. It is shared by the twc_url handler and the
+// forward-proxy listener (plain HTTP and MITM'd CONNECT requests), which
+// authenticate and derive targetURL differently but otherwise behave the
+// same from here on.
+func serveTarget(w http.ResponseWriter, r *http.Request, targetURL string) {
+	// Match the request against the route table, if one was loaded. The
+	// first matching route's policy applies wherever a query param doesn't
+	// already override it.
+	route := routes.match(targetURL)
+
+	if !route.allowsMethod(r.Method) {
+		http.Error(w, "Method not allowed for this route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// Determine whether to skip the cache: an explicit query param always
+	// wins, otherwise fall back to the route's skip_cache_methods.
+	var skipCache bool
+	if query.Has(skipCacheParam) {
+		skipCache = query.Get(skipCacheParam) == "true"
+	} else {
+		skipCache = route.skipsCacheFor(r.Method)
+	}
 
-	// Optional cache expiry in seconds.
+	// Optional cache expiry in seconds: query param, then route default.
 	var expiryTime *time.Time
-	if expiryStr := r.URL.Query().Get(cacheExpiryParam); expiryStr != "" {
-		secs, err := strconv.Atoi(expiryStr)
+	switch {
+	case query.Has(cacheExpiryParam):
+		secs, err := strconv.Atoi(query.Get(cacheExpiryParam))
 		if err != nil || secs < 0 {
 			http.Error(w, "Invalid "+cacheExpiryParam+" parameter", http.StatusBadRequest)
 			return
 		}
 		t := time.Now().Add(time.Duration(secs) * time.Second)
 		expiryTime = &t
+	case route != nil && route.Expiry != nil:
+		t := time.Now().Add(time.Duration(*route.Expiry) * time.Second)
+		expiryTime = &t
 	}
 
 	// Read the request body (if any) for forwarding and as part of the cache key.
@@ -136,36 +249,86 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Compute a cache key based on the method, target URL, and request body.
-	cacheKey := computeCacheKey(r.Method, targetURL, reqBody)
+	// Extra header values the route wants folded into the cache key (a
+	// Vary-style contribution beyond method/URL/body).
+	var varyValues []string
+	if route != nil {
+		for _, name := range route.VaryHeaders {
+			varyValues = append(varyValues, name+"="+r.Header.Get(name))
+		}
+	}
+
+	// Compute a cache key based on the method, target URL, request body, and
+	// any route-specified vary headers.
+	cacheKey := computeCacheKey(r.Method, targetURL, reqBody, varyValues...)
 
 	// Check cache unless skipCache is requested.
 	if !skipCache {
-		var cachedResp string
+		var cachedResp []byte
+		var blobPath sql.NullString
 		var cachedHeaders string
 		var cachedStatusCode int
-		err := db.QueryRow("SELECT response, headers, status_code FROM cache WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)", cacheKey, time.Now()).Scan(&cachedResp, &cachedHeaders, &cachedStatusCode)
+		var expiresAt sql.NullTime
+		err := db.QueryRow("SELECT response, blob_path, headers, status_code, expires_at FROM cache WHERE key = ?", cacheKey).Scan(&cachedResp, &blobPath, &cachedHeaders, &cachedStatusCode, &expiresAt)
 		if err == nil {
-			// Found valid cached response.
-			// Set our custom header to indicate the response comes from cache.
-			w.Header().Set(cacheHitHeaderName, "true")
-			// Restore allowed headers.
-			var headerMap map[string][]string
-			if err := json.Unmarshal([]byte(cachedHeaders), &headerMap); err != nil {
-				log.Printf("Error unmarshaling cached headers: %v", err)
-			} else {
-				for name, values := range headerMap {
-					for _, v := range values {
-						w.Header().Add(name, v)
+			fresh := !expiresAt.Valid || expiresAt.Time.After(time.Now())
+			stale := false
+			if !fresh && route != nil && route.StaleWhileRevalidate != nil {
+				staleDeadline := expiresAt.Time.Add(time.Duration(*route.StaleWhileRevalidate) * time.Second)
+				stale = time.Now().Before(staleDeadline)
+			}
+
+			if fresh || stale {
+				// Restore allowed headers.
+				var headerMap map[string][]string
+				if err := json.Unmarshal([]byte(cachedHeaders), &headerMap); err != nil {
+					log.Printf("Error unmarshaling cached headers: %v", err)
+				} else {
+					for name, values := range headerMap {
+						for _, v := range values {
+							w.Header().Add(name, v)
+						}
 					}
 				}
+
+				if stale {
+					w.Header().Set(cacheHitHeaderName, "stale")
+					triggerBackgroundRefresh(route, cacheKey, targetURL, r, reqBody, expiryTime)
+				} else {
+					w.Header().Set(cacheHitHeaderName, "true")
+				}
+
+				if blobPath.Valid {
+					f, ferr := os.Open(blobPath.String)
+					if ferr != nil {
+						log.Printf("Error opening cached blob %q: %v", blobPath.String, ferr)
+						http.Error(w, "Error reading cached response", http.StatusInternalServerError)
+						return
+					}
+					defer f.Close()
+					w.WriteHeader(cachedStatusCode)
+					io.Copy(w, f)
+				} else {
+					w.WriteHeader(cachedStatusCode)
+					w.Write(cachedResp)
+				}
+				return
 			}
-			w.WriteHeader(cachedStatusCode)
-			w.Write([]byte(cachedResp))
-			return
 		}
 	}
 
+	fetchAndCache(w, r, route, targetURL, cacheKey, reqBody, skipCache, expiryTime)
+}
+
+// fetchAndCache forwards r to targetURL, writes the response to w, and
+// (unless skipCache) stores it under cacheKey with expiryTime. It holds the
+// parts of serveTarget that happen after the route/skip-cache/cache-key
+// decisions have already been made, so callers that already know those
+// answers - namely triggerBackgroundRefresh - can fetch-and-store without
+// re-deriving them.
+func fetchAndCache(w http.ResponseWriter, r *http.Request, route *Route, targetURL, cacheKey string, reqBody []byte, skipCache bool, expiryTime *time.Time) {
+	query := r.URL.Query()
+
 	// Create the forwarded request.
 	forwardReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(reqBody))
 	if err != nil {
@@ -173,15 +336,19 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set request timeout
-	timeout := 15 * time.Second // default timeout
-	if timeoutStr := r.URL.Query().Get(timeoutParam); timeoutStr != "" {
-		secs, err := strconv.Atoi(timeoutStr)
+	// Set request timeout: query param, then route default, then the
+	// built-in default.
+	timeout := 15 * time.Second
+	switch {
+	case query.Has(timeoutParam):
+		secs, err := strconv.Atoi(query.Get(timeoutParam))
 		if err != nil || secs < 5 || secs > 120 {
 			http.Error(w, "Invalid "+timeoutParam+" parameter (must be between 5 and 120 seconds)", http.StatusBadRequest)
 			return
 		}
 		timeout = time.Duration(secs) * time.Second
+	case route != nil && route.Timeout != nil:
+		timeout = time.Duration(*route.Timeout) * time.Second
 	}
 
 	// Forward all headers except the auth header.
@@ -194,20 +361,54 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Pick an upstream proxy to dial through, if any: query param, then the
+	// route's upstream selector.
+	up := query.Get(upstreamParam)
+	if up == "" && route != nil {
+		up = route.Upstream
+	}
+	var upstream *upstreamEntry
+	switch up {
+	case "", "auto":
+		upstream = pool.pick()
+	case "none":
+		// upstream stays nil: dial the target directly.
+	default:
+		upstream, err = pool.byURL(up)
+		if err != nil {
+			http.Error(w, "Invalid "+upstreamParam+" parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Send the forwarded request.
 	client := &http.Client{Timeout: timeout}
+	if upstream != nil {
+		client.Transport = upstream.client.Transport
+	}
 	resp, err := client.Do(forwardReq)
 	if err != nil {
+		if upstream != nil {
+			upstream.markFailure()
+		}
 		http.Error(w, "Error forwarding request: "+err.Error(), http.StatusBadGateway)
 		return
 	}
+	if upstream != nil {
+		upstream.markSuccess()
+	}
 	defer resp.Body.Close()
 
-	// Read the response body.
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error reading response: "+err.Error(), http.StatusInternalServerError)
-		return
+	// Optional per-request override of the max_body_bytes guard; it can only
+	// tighten the server-wide cap, never loosen it.
+	bodyLimit := maxBodyBytes
+	if v := r.URL.Query().Get(maxBodyBytesParam); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || n > maxBodyBytes {
+			http.Error(w, "Invalid "+maxBodyBytesParam+" parameter", http.StatusBadRequest)
+			return
+		}
+		bodyLimit = n
 	}
 
 	// Copy response headers to the client.
@@ -216,48 +417,97 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(name, v)
 		}
 	}
+	if r.URL.Query().Get(streamParam) == "true" {
+		// Force chunked passthrough: the final size isn't known up front.
+		w.Header().Del("Content-Length")
+	}
+	if resp.ContentLength < 0 || resp.ContentLength > bodyLimit {
+		// The body will be truncated to bodyLimit below; the upstream's
+		// Content-Length would then no longer match what we actually send,
+		// so force chunked passthrough instead of an inconsistent length.
+		w.Header().Del("Content-Length")
+	}
 	w.WriteHeader(resp.StatusCode)
-	w.Write(respBody)
 
-	// Cache the response if not skipping cache.
-	if !skipCache {
-		// Filter allowed headers.
-		allowedKeys := []string{
-			"Content-Type", "Content-Encoding", "Cache-Control",
-			"Expires", "ETag", "Last-Modified", "Vary",
-		}
-		filteredHeaders := make(map[string][]string)
-		for _, key := range allowedKeys {
-			if vals, ok := resp.Header[key]; ok {
-				filteredHeaders[key] = vals
-			}
+	if skipCache {
+		// Nothing to spool; stream straight through, bounded by bodyLimit.
+		if _, err := io.Copy(w, io.LimitReader(resp.Body, bodyLimit)); err != nil {
+			log.Printf("Error streaming response: %v", err)
 		}
+		return
+	}
 
-		// Serialize filtered headers to JSON.
-		headersJSON, err := json.Marshal(filteredHeaders)
-		if err != nil {
-			log.Printf("Error marshaling response headers: %v", err)
+	// Stream the body to the client and a temp file at once, hashing it as
+	// it goes, so a single large response never has to be held in memory.
+	tmpPath, size, sum, err := spoolResponse(w, resp.Body, bodyLimit)
+	if err != nil {
+		log.Printf("Error spooling response for caching: %v", err)
+		return
+	}
+
+	// Filter allowed headers.
+	allowedKeys := []string{
+		"Content-Type", "Content-Encoding", "Cache-Control",
+		"Expires", "ETag", "Last-Modified", "Vary",
+	}
+	filteredHeaders := make(map[string][]string)
+	for _, key := range allowedKeys {
+		if vals, ok := resp.Header[key]; ok {
+			filteredHeaders[key] = vals
 		}
+	}
 
-		var execErr error
-		if expiryTime != nil {
-			_, execErr = db.Exec("INSERT OR REPLACE INTO cache (key, response, headers, status_code, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
-				cacheKey, string(respBody), string(headersJSON), resp.StatusCode, time.Now(), *expiryTime)
-		} else {
-			_, execErr = db.Exec("INSERT OR REPLACE INTO cache (key, response, headers, status_code, created_at, expires_at) VALUES (?, ?, ?, ?, ?, NULL)",
-				cacheKey, string(respBody), string(headersJSON), resp.StatusCode, time.Now())
+	// Serialize filtered headers to JSON.
+	headersJSON, err := json.Marshal(filteredHeaders)
+	if err != nil {
+		log.Printf("Error marshaling response headers: %v", err)
+	}
+
+	// Small responses stay inline in the database; larger ones are promoted
+	// to a content-addressed blob file and referenced by path.
+	var responseBlob []byte
+	var blobPath *string
+	if size <= inlineThresholdBytes {
+		data, readErr := os.ReadFile(tmpPath)
+		os.Remove(tmpPath)
+		if readErr != nil {
+			log.Printf("Error reading spooled response %q: %v", tmpPath, readErr)
+			return
 		}
-		if execErr != nil {
-			log.Printf("Error caching response: %v", execErr)
+		responseBlob = data
+	} else {
+		path, promoteErr := promoteToBlob(tmpPath, sum)
+		if promoteErr != nil {
+			log.Printf("Error promoting response to blob: %v", promoteErr)
+			return
 		}
+		blobPath = &path
+	}
+
+	var execErr error
+	if expiryTime != nil {
+		_, execErr = db.Exec("INSERT OR REPLACE INTO cache (key, response, blob_path, headers, status_code, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			cacheKey, responseBlob, blobPath, string(headersJSON), resp.StatusCode, time.Now(), *expiryTime)
+	} else {
+		_, execErr = db.Exec("INSERT OR REPLACE INTO cache (key, response, blob_path, headers, status_code, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, NULL)",
+			cacheKey, responseBlob, blobPath, string(headersJSON), resp.StatusCode, time.Now())
+	}
+	if execErr != nil {
+		log.Printf("Error caching response: %v", execErr)
 	}
 }
 
-// computeCacheKey returns a SHA256 hash string based on method, URL, and request body.
-func computeCacheKey(method, urlStr string, body []byte) string {
+// computeCacheKey returns a SHA256 hash string based on method, URL, request
+// body, and any extra vary values a route wants folded in (e.g. the value of
+// a header named in its vary_headers list).
+func computeCacheKey(method, urlStr string, body []byte, varyValues ...string) string {
 	h := sha256.New()
 	h.Write([]byte(method))
 	h.Write([]byte(urlStr))
 	h.Write(body)
+	for _, v := range varyValues {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
 	return hex.EncodeToString(h.Sum(nil))
 }
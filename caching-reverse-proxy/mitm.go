@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// caSigner mints per-host TLS leaf certificates signed by a loaded CA, for
+// use when MITM-ing a CONNECT tunnel. Leaves are cached for reuse.
+type caSigner struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+
+	mu    sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+// loadCASigner reads a PEM-encoded CA certificate and RSA private key.
+func loadCASigner(certPath, keyPath string) (*caSigner, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA cert %q: %v", certPath, err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no PEM block found in CA cert %q", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CA cert %q: %v", certPath, err)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA key %q: %v", keyPath, err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no PEM block found in CA key %q", keyPath)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CA key %q: %v", keyPath, err)
+	}
+
+	return &caSigner{cert: cert, key: key, cache: make(map[string]*tls.Certificate)}, nil
+}
+
+// leafFor returns a TLS certificate for host, generating and caching a new
+// one signed by the CA on first use.
+func (c *caSigner) leafFor(host string) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if leaf, ok := c.cache[host]; ok {
+		c.mu.Unlock()
+		return leaf, nil
+	}
+	c.mu.Unlock()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating leaf key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &priv.PublicKey, c.key)
+	if err != nil {
+		return nil, fmt.Errorf("signing leaf certificate for %q: %v", host, err)
+	}
+
+	leaf := &tls.Certificate{
+		Certificate: [][]byte{der, c.cert.Raw},
+		PrivateKey:  priv,
+	}
+
+	c.mu.Lock()
+	c.cache[host] = leaf
+	c.mu.Unlock()
+	return leaf, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshGroup collapses concurrent background refreshes of the same cache
+// key into a single upstream fetch.
+var refreshGroup singleflight.Group
+
+// refreshesInFlight tracks cache keys with a background refresh already
+// running, so repeated stale hits on the same key don't each spawn their own
+// goroutine while one is already under way.
+var refreshesInFlight sync.Map
+
+// triggerBackgroundRefresh re-fetches targetURL and re-populates the cache,
+// without blocking the client that's being served the stale copy. route,
+// cacheKey and expiryTime are the ones serveTarget already derived for this
+// request, so the refresh fetches and stores directly instead of recursing
+// back through serveTarget's route/skip-cache/cache-key logic. Identical
+// refreshes already in flight are deduplicated via refreshGroup, and a
+// second stale hit for a key already refreshing is a no-op.
+func triggerBackgroundRefresh(route *Route, cacheKey, targetURL string, r *http.Request, reqBody []byte, expiryTime *time.Time) {
+	if _, already := refreshesInFlight.LoadOrStore(cacheKey, struct{}{}); already {
+		return
+	}
+
+	go func() {
+		defer refreshesInFlight.Delete(cacheKey)
+		refreshGroup.Do(cacheKey, func() (interface{}, error) {
+			refreshReq := r.Clone(context.Background())
+			refreshReq.Body = io.NopCloser(bytes.NewReader(reqBody))
+			fetchAndCache(newDiscardResponseWriter(), refreshReq, route, targetURL, cacheKey, reqBody, false, expiryTime)
+			return nil, nil
+		})
+	}()
+}
+
+// discardResponseWriter satisfies http.ResponseWriter for a background
+// refresh, which only cares about the side effect of re-populating the
+// cache and has no real client connection to write to.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponseWriter) WriteHeader(statusCode int)  {}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RouteConfig is the top-level shape of -config: an ordered list of routes.
+// The first route whose host/path patterns match a request's target URL
+// wins; query-param overrides still take precedence over whatever it sets.
+type RouteConfig struct {
+	Routes []*Route `yaml:"routes" json:"routes"`
+}
+
+// Route pairs a host/path match with the cache policy to apply when it
+// matches.
+type Route struct {
+	Host                 string   `yaml:"host" json:"host"`
+	Path                 string   `yaml:"path" json:"path"`
+	Expiry               *int     `yaml:"expiry" json:"expiry"`   // seconds; default cache expiry for this route
+	Timeout              *int     `yaml:"timeout" json:"timeout"` // seconds; default upstream timeout for this route
+	SkipCacheMethods     []string `yaml:"skip_cache_methods" json:"skip_cache_methods"`
+	AllowedMethods       []string `yaml:"allowed_methods" json:"allowed_methods"`
+	Upstream             string   `yaml:"upstream" json:"upstream"` // twc_upstream selector: none, auto, or a pinned URL
+	VaryHeaders          []string `yaml:"vary_headers" json:"vary_headers"`
+	StaleWhileRevalidate *int     `yaml:"stale_while_revalidate" json:"stale_while_revalidate"` // seconds
+
+	hostRe *regexp.Regexp
+	pathRe *regexp.Regexp
+}
+
+// loadRouteConfig reads a YAML or JSON route config (selected by file
+// extension) and compiles each route's host/path patterns.
+func loadRouteConfig(path string) (*RouteConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg RouteConfig
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, &cfg)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	default:
+		return nil, fmt.Errorf("unrecognized config extension %q (want .yaml, .yml, or .json)", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", path, err)
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Host != "" {
+			re, err := regexp.Compile(route.Host)
+			if err != nil {
+				return nil, fmt.Errorf("compiling host pattern %q: %v", route.Host, err)
+			}
+			route.hostRe = re
+		}
+		if route.Path != "" {
+			re, err := regexp.Compile(route.Path)
+			if err != nil {
+				return nil, fmt.Errorf("compiling path pattern %q: %v", route.Path, err)
+			}
+			route.pathRe = re
+		}
+	}
+	return &cfg, nil
+}
+
+// match returns the first route whose host/path patterns match targetURL, or
+// nil if none do (callers fall back to global defaults) or no config was
+// loaded.
+func (c *RouteConfig) match(targetURL string) *Route {
+	if c == nil {
+		return nil
+	}
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		return nil
+	}
+	for _, route := range c.Routes {
+		if route.hostRe != nil && !route.hostRe.MatchString(u.Host) {
+			continue
+		}
+		if route.pathRe != nil && !route.pathRe.MatchString(u.Path) {
+			continue
+		}
+		return route
+	}
+	return nil
+}
+
+// skipsCacheFor reports whether this route's policy skips caching for
+// method by default (e.g. POST, unless the route's author leaves it out of
+// skip_cache_methods to opt it in).
+func (route *Route) skipsCacheFor(method string) bool {
+	if route == nil {
+		return false
+	}
+	for _, m := range route.SkipCacheMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMethod reports whether method is permitted by this route's
+// allow-list. An unset route, or a route with no allow-list, permits
+// everything.
+func (route *Route) allowsMethod(method string) bool {
+	if route == nil || len(route.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range route.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
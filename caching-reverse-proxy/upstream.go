@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// Query parameter to pin or bypass the upstream proxy pool.
+	upstreamParam = "twc_upstream"
+
+	// defaultUpstreamFile is the pool file produced by the proxy-tester tool.
+	defaultUpstreamFile = "working_proxies"
+
+	upstreamMaxFailures = 3
+	upstreamCooldown    = 2 * time.Minute
+)
+
+// upstreamEntry is one upstream proxy and its recent health.
+type upstreamEntry struct {
+	raw    string
+	client *http.Client
+
+	mu        sync.Mutex
+	failures  int
+	ejectedAt time.Time
+}
+
+func (e *upstreamEntry) ejected() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ejectedAt.IsZero() {
+		return false
+	}
+	if time.Since(e.ejectedAt) > upstreamCooldown {
+		// Cool-down elapsed; give it another chance.
+		e.ejectedAt = time.Time{}
+		e.failures = 0
+		return false
+	}
+	return true
+}
+
+func (e *upstreamEntry) markFailure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	if e.failures >= upstreamMaxFailures {
+		e.ejectedAt = time.Now()
+	}
+}
+
+func (e *upstreamEntry) markSuccess() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = 0
+	e.ejectedAt = time.Time{}
+}
+
+// upstreamPool is a rotating pool of upstream proxies loaded from a file
+// (normally the working_proxies file produced by proxy-tester) and
+// auto-reloaded whenever the file's mtime changes.
+type upstreamPool struct {
+	path string
+
+	mu      sync.Mutex
+	entries []*upstreamEntry
+	cursor  uint64
+	modTime time.Time
+}
+
+// newUpstreamPool creates a pool backed by path and performs an initial load.
+func newUpstreamPool(path string) *upstreamPool {
+	p := &upstreamPool{path: path}
+	p.reload()
+	return p
+}
+
+// reload re-reads the pool file if its mtime has changed since the last load.
+func (p *upstreamPool) reload() {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return // missing pool file just means an empty pool
+	}
+
+	p.mu.Lock()
+	stale := !info.ModTime().Equal(p.modTime)
+	p.mu.Unlock()
+	if !stale {
+		return
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		log.Printf("Error reloading upstream pool %q: %v", p.path, err)
+		return
+	}
+
+	var entries []*upstreamEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		raw := strings.TrimSpace(line)
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		client, err := upstreamClient(raw)
+		if err != nil {
+			log.Printf("Skipping upstream proxy %q: %v", raw, err)
+			continue
+		}
+		entries = append(entries, &upstreamEntry{raw: raw, client: client})
+	}
+
+	p.mu.Lock()
+	p.entries = entries
+	p.modTime = info.ModTime()
+	p.mu.Unlock()
+	log.Printf("Loaded %d upstream proxies from %q", len(entries), p.path)
+}
+
+// pick returns the next healthy upstream entry, round-robin, or nil if the
+// pool is empty or every entry is currently ejected.
+func (p *upstreamPool) pick() *upstreamEntry {
+	p.reload()
+
+	p.mu.Lock()
+	entries := p.entries
+	p.mu.Unlock()
+
+	n := len(entries)
+	for i := 0; i < n; i++ {
+		idx := int(atomic.AddUint64(&p.cursor, 1)-1) % n
+		if e := entries[idx]; !e.ejected() {
+			return e
+		}
+	}
+	return nil
+}
+
+// byURL builds a one-off entry for an explicitly pinned upstream proxy.
+func (p *upstreamPool) byURL(spec string) (*upstreamEntry, error) {
+	client, err := upstreamClient(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamEntry{raw: spec, client: client}, nil
+}
+
+// upstreamClient builds an http.Client that dials outbound requests through
+// the given proxy spec. Entries without a "scheme://" prefix default to
+// http, matching detectDefaultScheme's fallback in proxy-tester.
+func upstreamClient(spec string) (*http.Client, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "http://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", spec, err)
+	}
+
+	switch u.Scheme {
+	case "socks4", "socks5":
+		dialer, err := proxy.SOCKS5("tcp", u.Host, nil, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("creating %s dialer: %v", u.Scheme, err)
+		}
+		return &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}, nil
+	case "http", "https":
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// judge is a URL the checker round-robins requests through to observe what
+// the far end sees of the connection (echoed headers, origin IP). https
+// marks judges fetched over TLS, so every proxy can also be round-tripped
+// through at least one of them to verify it really completes a TLS
+// handshake, not just a plaintext GET.
+type judge struct {
+	url   string
+	https bool
+}
+
+// parseJudges builds the judge list from raw -judge URLs.
+func parseJudges(raw []string) []judge {
+	judges := make([]judge, 0, len(raw))
+	for _, u := range raw {
+		judges = append(judges, judge{url: u, https: strings.HasPrefix(u, "https://")})
+	}
+	return judges
+}
+
+var judgeCursor uint64
+
+// nextJudge picks the next judge round-robin.
+func nextJudge(judges []judge) judge {
+	idx := int(atomic.AddUint64(&judgeCursor, 1)-1) % len(judges)
+	return judges[idx]
+}
+
+var httpsJudgeCursor uint64
+
+// nextHTTPSJudge round-robins among just the https judges in the list, so a
+// proxy's HTTPS capability can be confirmed against a real judge round-trip
+// instead of only the CONNECT/SOCKS-dial probe in checkHTTPSTunnel. It
+// reports ok=false if judges contains no https judge.
+func nextHTTPSJudge(judges []judge) (judge, bool) {
+	var httpsJudges []judge
+	for _, j := range judges {
+		if j.https {
+			httpsJudges = append(httpsJudges, j)
+		}
+	}
+	if len(httpsJudges) == 0 {
+		return judge{}, false
+	}
+	idx := int(atomic.AddUint64(&httpsJudgeCursor, 1)-1) % len(httpsJudges)
+	return httpsJudges[idx], true
+}
+
+// judgeResponse is the shape returned by httpbin-style "echo" judges: the
+// origin IP the judge saw the request arrive from, and the headers it
+// received.
+type judgeResponse struct {
+	Origin  string            `json:"origin"`
+	Headers map[string]string `json:"headers"`
+}
+
+// ProxyResult is the full outcome of testing one proxy.
+type ProxyResult struct {
+	Proxy        string `json:"proxy"`
+	Working      bool   `json:"working"`
+	Anonymity    string `json:"anonymity,omitempty"`
+	ExitIP       string `json:"exit_ip,omitempty"`
+	TTFBMillis   int64  `json:"ttfb_ms,omitempty"`
+	TotalMillis  int64  `json:"total_ms,omitempty"`
+	HTTPSCapable bool   `json:"https_capable"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Anonymity classifications, ranked from least to most private.
+const (
+	AnonymityTransparent = "transparent"
+	AnonymityAnonymous   = "anonymous"
+	AnonymityElite       = "elite"
+)
+
+var anonymityRank = map[string]int{
+	AnonymityTransparent: 0,
+	AnonymityAnonymous:   1,
+	AnonymityElite:       2,
+}
+
+// meetsMinAnonymity reports whether got is at least as private as min. An
+// empty min (no -min-anonymity flag) matches everything.
+func meetsMinAnonymity(got, min string) bool {
+	if min == "" {
+		return true
+	}
+	return anonymityRank[got] >= anonymityRank[min]
+}
+
+// classifyAnonymity inspects the headers a judge echoed back to determine
+// how much the proxy reveals about the original client: transparent if the
+// client's own IP leaks through a proxy-marker header, anonymous if proxy
+// markers are present without the client IP, elite if neither appears.
+func classifyAnonymity(headers map[string]string, selfIP string) string {
+	markerNames := []string{"Via", "X-Forwarded-For", "Forwarded", "Client-Ip"}
+
+	sawMarker := false
+	leaksSelfIP := false
+	for name, value := range headers {
+		for _, marker := range markerNames {
+			if !strings.EqualFold(name, marker) {
+				continue
+			}
+			sawMarker = true
+			if selfIP != "" && strings.Contains(value, selfIP) {
+				leaksSelfIP = true
+			}
+		}
+	}
+
+	switch {
+	case leaksSelfIP:
+		return AnonymityTransparent
+	case sawMarker:
+		return AnonymityAnonymous
+	default:
+		return AnonymityElite
+	}
+}
+
+// detectSelfIP fetches our own public IP directly (no proxy), so
+// classifyAnonymity can recognize when a proxy leaks it.
+func detectSelfIP() (string, error) {
+	resp, err := http.Get("https://ifconfig.me/ip")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// checkHTTPSTunnel confirms the proxy can actually tunnel HTTPS traffic
+// rather than only serve plaintext GETs: for http/https proxies it opens a
+// raw CONNECT to a well-known HTTPS host, and for SOCKS proxies it dials the
+// same host through the SOCKS tunnel.
+func checkHTTPSTunnel(u *url.URL) bool {
+	const target = "www.google.com:443"
+
+	switch u.Scheme {
+	case "http", "https":
+		conn, err := net.DialTimeout("tcp", u.Host, 8*time.Second)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		conn.SetDeadline(time.Now().Add(8 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+
+	case "socks4", "socks5":
+		dialer, err := proxy.SOCKS5("tcp", u.Host, nil, proxy.Direct)
+		if err != nil {
+			return false
+		}
+		conn, err := dialer.Dial("tcp", target)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+
+	default:
+		return false
+	}
+}
+
+// verifyViaHTTPSJudge fetches j through client to confirm the proxy can
+// complete a real TLS handshake and round-trip, rather than just tunneling
+// bytes like checkHTTPSTunnel's CONNECT/SOCKS-dial probe does.
+func verifyViaHTTPSJudge(client *http.Client, j judge) bool {
+	resp, err := client.Get(j.url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode == http.StatusOK
+}
+
+// testProxy exercises proxyStr against a round-robin judge and classifies
+// the result: latency, exit IP, anonymity, and HTTPS-tunneling support.
+func testProxy(proxyStr string, judges []judge, selfIP string) ProxyResult {
+	result := ProxyResult{Proxy: proxyStr}
+
+	u, err := url.Parse(proxyStr)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to parse proxy: %v", err)
+		return result
+	}
+
+	client := &http.Client{Timeout: 12 * time.Second}
+	switch u.Scheme {
+	case "socks5", "socks4":
+		dialer, err := proxy.SOCKS5("tcp", u.Host, nil, proxy.Direct)
+		if err != nil {
+			result.Error = fmt.Sprintf("creating %s dialer: %v", u.Scheme, err)
+			return result
+		}
+		client.Transport = &http.Transport{Dial: dialer.Dial}
+
+	case "http", "https":
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(u)}
+
+	default:
+		result.Error = fmt.Sprintf("unsupported proxy scheme %q", u.Scheme)
+		return result
+	}
+
+	j := nextJudge(judges)
+	start := time.Now()
+	resp, err := client.Get(j.url)
+	if err != nil {
+		result.Error = fmt.Sprintf("request to judge failed: %v", err)
+		return result
+	}
+	defer resp.Body.Close()
+	ttfb := time.Since(start)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		result.Error = fmt.Sprintf("reading judge response: %v", err)
+		return result
+	}
+	total := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		result.Error = fmt.Sprintf("non-OK status from judge: %d", resp.StatusCode)
+		return result
+	}
+
+	var parsed judgeResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		result.Error = fmt.Sprintf("parsing judge response: %v", err)
+		return result
+	}
+
+	result.Working = true
+	result.TTFBMillis = ttfb.Milliseconds()
+	result.TotalMillis = total.Milliseconds()
+	result.ExitIP = parsed.Origin
+	result.Anonymity = classifyAnonymity(parsed.Headers, selfIP)
+
+	// Prefer verifying HTTPS capability against a real HTTPS judge
+	// round-trip; fall back to the CONNECT/SOCKS-dial probe when no https
+	// judge was configured.
+	if hj, ok := nextHTTPSJudge(judges); ok {
+		result.HTTPSCapable = verifyViaHTTPSJudge(client, hj)
+	} else {
+		result.HTTPSCapable = checkHTTPSTunnel(u)
+	}
+	return result
+}
+
+// writeResultsTxt writes one proxy string per line, matching the tool's
+// original output format.
+func writeResultsTxt(path string, results []ProxyResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, r := range results {
+		if _, err := f.WriteString(r.Proxy + "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResultsJSONL writes one JSON-encoded ProxyResult per line.
+func writeResultsJSONL(path string, results []ProxyResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeResultsCSV writes the results as CSV with a header row.
+func writeResultsCSV(path string, results []ProxyResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	defer w.Flush()
+
+	if err := w.Write([]string{"proxy", "working", "anonymity", "exit_ip", "ttfb_ms", "total_ms", "https_capable", "error"}); err != nil {
+		return err
+	}
+	for _, r := range results {
+		row := []string{
+			r.Proxy,
+			strconv.FormatBool(r.Working),
+			r.Anonymity,
+			r.ExitIP,
+			strconv.FormatInt(r.TTFBMillis, 10),
+			strconv.FormatInt(r.TotalMillis, 10),
+			strconv.FormatBool(r.HTTPSCapable),
+			r.Error,
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
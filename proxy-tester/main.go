@@ -6,13 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
 	"sync"
-	"time"
-
-	"golang.org/x/net/proxy"
 )
 
 // fetchProxies downloads proxies from the provided URL.
@@ -72,69 +68,48 @@ func detectDefaultScheme(inputURL string) (string, error) {
 	}
 }
 
-// testProxy tests the provided proxy URL by performing an HTTP GET request to a test endpoint.
-func testProxy(proxyStr string) bool {
-	u, err := url.Parse(proxyStr)
-	if err != nil {
-		fmt.Printf("Failed to parse proxy '%s': %v\n", proxyStr, err)
-		return false
-	}
+// judgeURLsFlag collects repeatable -judge flag values.
+type judgeURLsFlag []string
 
-	// Set up a client with a timeout.
-	client := &http.Client{
-		Timeout: 12 * time.Second,
-	}
+func (j *judgeURLsFlag) String() string { return strings.Join(*j, ",") }
+func (j *judgeURLsFlag) Set(v string) error {
+	*j = append(*j, v)
+	return nil
+}
 
-	// Configure transport based on the proxy scheme.
-	switch u.Scheme {
-	case "socks5", "socks4":
-		// For SOCKS proxies, use golang.org/x/net/proxy.
-		dialer, err := proxy.SOCKS5("tcp", u.Host, nil, proxy.Direct)
-		if err != nil {
-			fmt.Printf("Error creating %s dialer for '%s': %v\n", u.Scheme, proxyStr, err)
-			return false
-		}
-		transport := &http.Transport{
-			Dial: dialer.Dial,
-		}
-		client.Transport = transport
+// defaultJudgeURLs is used when no -judge flag is given: one HTTP judge and
+// one HTTPS judge, so HTTPS support gets exercised even for plain targets.
+var defaultJudgeURLs = []string{"http://httpbin.org/get", "https://httpbin.org/get"}
 
-	case "http", "https":
-		transport := &http.Transport{
-			Proxy: http.ProxyURL(u),
-		}
-		client.Transport = transport
+func main() {
+	// Define a flag for concurrency (cost).
+	cost := flag.Int("cost", 10, "Number of concurrent proxy tests")
+	outFormat := flag.String("out", "txt", "output format for the working_proxies file: jsonl, csv, or txt")
+	minAnonymity := flag.String("min-anonymity", "", "minimum anonymity to keep: transparent, anonymous, or elite (default: keep all working proxies)")
+	var judgeURLs judgeURLsFlag
+	flag.Var(&judgeURLs, "judge", "judge URL to round-robin requests through (repeatable; default: one HTTP + one HTTPS judge)")
+	flag.Parse()
 
-	default:
-		fmt.Printf("Unsupported proxy scheme '%s' in '%s'\n", u.Scheme, proxyStr)
-		return false
+	if *minAnonymity != "" {
+		if _, ok := anonymityRank[*minAnonymity]; !ok {
+			fmt.Printf("Invalid -min-anonymity value %q\n", *minAnonymity)
+			return
+		}
 	}
-
-	// Test URL that returns our IP address.
-	resp, err := client.Get("https://ifconfig.me/ip")
-	if err != nil {
-		fmt.Printf("Request failed for proxy '%s': %v\n", proxyStr, err)
-		return false
+	if len(judgeURLs) == 0 {
+		judgeURLs = defaultJudgeURLs
 	}
-	defer resp.Body.Close()
+	judges := parseJudges(judgeURLs)
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Non-OK status for proxy '%s': %d\n", proxyStr, resp.StatusCode)
-		return false
+	selfIP, err := detectSelfIP()
+	if err != nil {
+		fmt.Printf("Warning: failed to detect own IP, anonymity classification will be degraded: %v\n", err)
 	}
 
-	return true
-}
-
-func main() {
-	// Define a flag for concurrency (cost).
-	cost := flag.Int("cost", 10, "Number of concurrent proxy tests")
-	flag.Parse()
-
 	// The remaining arguments are URLs to proxy lists.
 	urls := flag.Args()
 	if len(urls) < 1 {
-		fmt.Println("Usage: go run main.go -cost=<number> <proxy_list_url1> [<proxy_list_url2> ...]")
+		fmt.Println("Usage: go run main.go -cost=<number> -out=<jsonl|csv|txt> -min-anonymity=<elite|anonymous|transparent> <proxy_list_url1> [<proxy_list_url2> ...]")
 		return
 	}
 
@@ -170,8 +145,8 @@ func main() {
 
 	// Channel to feed proxies to workers.
 	proxyCh := make(chan string)
-	// Channel to collect working proxies.
-	workingCh := make(chan string)
+	// Channel to collect results for proxies that pass the anonymity filter.
+	workingCh := make(chan ProxyResult)
 
 	var wg sync.WaitGroup
 
@@ -182,11 +157,15 @@ func main() {
 			defer wg.Done()
 			for proxyStr := range proxyCh {
 				fmt.Printf("Testing proxy: %s\n", proxyStr)
-				if testProxy(proxyStr) {
-					fmt.Printf("Proxy works: %s\n", proxyStr)
-					workingCh <- proxyStr
-				} else {
-					fmt.Printf("Proxy failed: %s\n", proxyStr)
+				result := testProxy(proxyStr, judges, selfIP)
+				switch {
+				case result.Working && meetsMinAnonymity(result.Anonymity, *minAnonymity):
+					fmt.Printf("Proxy works: %s (%s, %dms)\n", proxyStr, result.Anonymity, result.TotalMillis)
+					workingCh <- result
+				case result.Working:
+					fmt.Printf("Proxy works but below -min-anonymity: %s (%s)\n", proxyStr, result.Anonymity)
+				default:
+					fmt.Printf("Proxy failed: %s (%s)\n", proxyStr, result.Error)
 				}
 			}
 		}()
@@ -206,27 +185,30 @@ func main() {
 		close(workingCh)
 	}()
 
-	// Collect working proxies.
-	var workingProxies []string
-	for wp := range workingCh {
-		workingProxies = append(workingProxies, wp)
+	// Collect results that passed the anonymity filter.
+	var results []ProxyResult
+	for r := range workingCh {
+		results = append(results, r)
 	}
 
-	// Write the working proxies to a file named "working_proxies".
 	outFileName := "working_proxies"
-	outFile, err := os.Create(outFileName)
-	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
+	var writeErr error
+	switch *outFormat {
+	case "jsonl":
+		outFileName += ".jsonl"
+		writeErr = writeResultsJSONL(outFileName, results)
+	case "csv":
+		outFileName += ".csv"
+		writeErr = writeResultsCSV(outFileName, results)
+	case "txt":
+		writeErr = writeResultsTxt(outFileName, results)
+	default:
+		fmt.Printf("Unknown -out format %q\n", *outFormat)
 		return
 	}
-	defer outFile.Close()
-
-	for _, wp := range workingProxies {
-		_, err := outFile.WriteString(wp + "\n")
-		if err != nil {
-			fmt.Printf("Error writing to output file: %v\n", err)
-			return
-		}
+	if writeErr != nil {
+		fmt.Printf("Error writing output file: %v\n", writeErr)
+		return
 	}
 
 	fmt.Printf("Working proxies have been written to %s\n", outFileName)